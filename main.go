@@ -1,6 +1,14 @@
 package main
 
-//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -type event_t bpf c/badfd.c
+// -target bpfel,bpfeb makes bpf2go emit a pair of objects per variant
+// (bpf_bpfel.go/bpf_bpfeb.go, bpfPerf_bpfel.go/bpfPerf_bpfeb.go), each
+// guarded by a //go:build constraint on GOARCH's endianness and each
+// embedding its compiled .o via //go:embed, so cross-compiling for a
+// big-endian target (s390x) doesn't silently run a little-endian program.
+// Run `make generate` rather than `go generate` directly -- see the
+// Makefile for the pinned clang image this depends on.
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -target bpfel,bpfeb -type event_t -type filter_config -type count_key -type count_val -type hist_key -type error_key bpf c/badfd.c
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -target bpfel,bpfeb -type event_t -type filter_config -type count_key -type count_val -type hist_key -type error_key bpfPerf c/badfd_perf.c
 
 import (
 	"bytes"
@@ -13,14 +21,175 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/perf"
 	"github.com/cilium/ebpf/ringbuf"
 	"github.com/cilium/ebpf/rlimit"
+	"golang.org/x/sys/unix"
+
+	"badfd/probe"
+)
+
+// Syscall ids. Keep in sync with enum syscall_id in c/badfd_common.h.
+const (
+	sysOpenat uint32 = iota
+	sysOpenat2
+	sysUnlinkat
+	sysStatx
+	sysRead
+	sysWrite
+	sysClose
 )
 
+// validSyscalls is the set of names -syscalls accepts. isPathSyscall (keyed
+// by BPF-side id, since that's what decoded events carry) is the only source
+// of truth for which syscalls are path-based vs fd-based -- this set just
+// answers "is this a syscall we know how to trace at all".
+var validSyscalls = map[string]bool{
+	"openat":   true,
+	"openat2":  true,
+	"unlinkat": true,
+	"statx":    true,
+	"read":     true,
+	"write":    true,
+	"close":    true,
+}
+
+var syscallIDNames = map[uint32]string{
+	sysOpenat:   "openat",
+	sysOpenat2:  "openat2",
+	sysUnlinkat: "unlinkat",
+	sysStatx:    "statx",
+	sysRead:     "read",
+	sysWrite:    "write",
+	sysClose:    "close",
+}
+
+func syscallName(id uint32) string {
+	if name, ok := syscallIDNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("sys(%d)", id)
+}
+
+func isPathSyscall(id uint32) bool {
+	switch id {
+	case sysOpenat, sysOpenat2, sysUnlinkat, sysStatx:
+		return true
+	default:
+		return false
+	}
+}
+
+// progPair bundles the enter/exit BPF programs bpf2go generated for one
+// syscall, so the attach loop in main can treat every syscall uniformly
+// regardless of which object variant (ringbuf or perf) loaded them.
+type progPair struct {
+	Entry *ebpf.Program
+	Exit  *ebpf.Program
+}
+
+// progPairsFromRingbuf/progPairsFromPerf resolve the Trace<Name>Entry/
+// Trace<Name>Exit program pair for each syscall out of whichever
+// bpf2go-generated object set got loaded. bpfObjects and bpfPerfObjects
+// expose identical field names -- only the concrete map types backing
+// Events differ -- so the rest of main() never needs to know which one
+// it's holding.
+func progPairsFromRingbuf(objs *bpfObjects) map[string]progPair {
+	return map[string]progPair{
+		"openat":   {objs.TraceOpenatEntry, objs.TraceOpenatExit},
+		"openat2":  {objs.TraceOpenat2Entry, objs.TraceOpenat2Exit},
+		"unlinkat": {objs.TraceUnlinkatEntry, objs.TraceUnlinkatExit},
+		"statx":    {objs.TraceStatxEntry, objs.TraceStatxExit},
+		"read":     {objs.TraceReadEntry, objs.TraceReadExit},
+		"write":    {objs.TraceWriteEntry, objs.TraceWriteExit},
+		"close":    {objs.TraceCloseEntry, objs.TraceCloseExit},
+	}
+}
+
+func progPairsFromPerf(objs *bpfPerfObjects) map[string]progPair {
+	return map[string]progPair{
+		"openat":   {objs.TraceOpenatEntry, objs.TraceOpenatExit},
+		"openat2":  {objs.TraceOpenat2Entry, objs.TraceOpenat2Exit},
+		"unlinkat": {objs.TraceUnlinkatEntry, objs.TraceUnlinkatExit},
+		"statx":    {objs.TraceStatxEntry, objs.TraceStatxExit},
+		"read":     {objs.TraceReadEntry, objs.TraceReadExit},
+		"write":    {objs.TraceWriteEntry, objs.TraceWriteExit},
+		"close":    {objs.TraceCloseEntry, objs.TraceCloseExit},
+	}
+}
+
+// sharedMaps is the subset of either generated object set that the rest of
+// main() operates on, so filter/metrics/threshold plumbing is written once
+// and works against whichever variant probe.Detect() picked.
+type sharedMaps struct {
+	Events             *ebpf.Map
+	TargetPids         *ebpf.Map
+	TargetCgroups      *ebpf.Map
+	FilterCfg          *ebpf.Map
+	ThresholdCfg       *ebpf.Map
+	SyscallTotals      *ebpf.Map
+	SyscallLatencyHist *ebpf.Map
+	SyscallErrors      *ebpf.Map
+}
+
+func mapsFromRingbuf(objs *bpfObjects) sharedMaps {
+	return sharedMaps{
+		Events:             objs.Events,
+		TargetPids:         objs.TargetPids,
+		TargetCgroups:      objs.TargetCgroups,
+		FilterCfg:          objs.FilterCfg,
+		ThresholdCfg:       objs.ThresholdCfg,
+		SyscallTotals:      objs.SyscallTotals,
+		SyscallLatencyHist: objs.SyscallLatencyHist,
+		SyscallErrors:      objs.SyscallErrors,
+	}
+}
+
+func mapsFromPerf(objs *bpfPerfObjects) sharedMaps {
+	return sharedMaps{
+		Events:             objs.Events,
+		TargetPids:         objs.TargetPids,
+		TargetCgroups:      objs.TargetCgroups,
+		FilterCfg:          objs.FilterCfg,
+		ThresholdCfg:       objs.ThresholdCfg,
+		SyscallTotals:      objs.SyscallTotals,
+		SyscallLatencyHist: objs.SyscallLatencyHist,
+		SyscallErrors:      objs.SyscallErrors,
+	}
+}
+
+// decodedEvent mirrors struct event_t in c/badfd_common.h. Both the
+// ringbuf and perf-event-array variants emit byte-identical records, so a
+// single hand-decoded type (rather than bpf2go's per-variant bpfEventT/
+// bpfPerfEventT) is enough to read either one.
+type decodedEvent struct {
+	Pid        uint32
+	Comm       [16]byte
+	SyscallId  uint32
+	DurationNs uint64
+	Ret        int32
+	Fd         int32
+	Count      uint64
+	Fname      [256]byte
+}
+
+// decodeEvent parses a raw event_t record in whatever byte order this
+// process's own architecture uses -- the loaded BPF program is always the
+// bpfel or bpfeb variant matching GOARCH (see the go:generate directive
+// above), so its output is native-endian for the host running this binary.
+func decodeEvent(raw []byte) (decodedEvent, error) {
+	var event decodedEvent
+	err := binary.Read(bytes.NewReader(raw), binary.NativeEndian, &event)
+	return event, err
+}
+
 // Manual mapping of common Linux error codes.
 // We avoid importing huge system libraries just for a few error strings.
 // These are the most relevant ones for file I/O operations.
@@ -32,6 +201,38 @@ var errnoNames = map[int32]string{
 	24: "EMFILE (Too many open files)",
 }
 
+// pidList accumulates the repeatable -pid flag into a slice of PIDs to
+// feed into the BPF target_pids filter map.
+type pidList []uint32
+
+func (p *pidList) String() string {
+	return fmt.Sprint([]uint32(*p))
+}
+
+func (p *pidList) Set(value string) error {
+	pid, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid pid %q: %w", value, err)
+	}
+	*p = append(*p, uint32(pid))
+	return nil
+}
+
+// resolveCgroupID maps a cgroup v2 directory to the kernel cgroup id the
+// BPF program sees from bpf_get_current_cgroup_id(), via the file handle
+// returned by name_to_handle_at(2).
+func resolveCgroupID(path string) (uint64, error) {
+	handle, _, err := unix.NameToHandleAt(unix.AT_FDCWD, path, 0)
+	if err != nil {
+		return 0, fmt.Errorf("name_to_handle_at %s: %w", path, err)
+	}
+	b := handle.Bytes()
+	if len(b) < 8 {
+		return 0, fmt.Errorf("unexpected cgroup handle size %d for %s", len(b), path)
+	}
+	return binary.NativeEndian.Uint64(b[:8]), nil
+}
+
 func fmtErr(ret int32) string {
 	if ret >= 0 {
 		return "OK"
@@ -49,9 +250,12 @@ type LogEntry struct {
 	Timestamp string `json:"ts"`
 	Pid       uint32 `json:"pid"`
 	Comm      string `json:"comm"`
+	Syscall   string `json:"syscall"`
 	LatencyNs uint64 `json:"lat_ns"`
 	Result    string `json:"result"`
-	File      string `json:"file"`
+	File      string `json:"file,omitempty"`
+	Fd        int32  `json:"fd,omitempty"`
+	Count     uint64 `json:"count,omitempty"`
 }
 
 func main() {
@@ -59,8 +263,29 @@ func main() {
 	msFlag := flag.Int("ms", 10, "Latency threshold in ms (0 = trace all)")
 	errOnly := flag.Bool("err", false, "Trace only errors (ignore latency)")
 	jsonFlag := flag.Bool("json", false, "Output in JSON format")
+	var pidFlag pidList
+	flag.Var(&pidFlag, "pid", "Only trace this PID (repeatable)")
+	cgroupFlag := flag.String("cgroup", "", "Only trace tasks in this cgroup v2 path")
+	syscallsFlag := flag.String("syscalls", "openat", "Comma-separated syscalls to trace (openat,openat2,unlinkat,statx,read,write,close)")
+	metricsFlag := flag.String("metrics", "", "Address to serve Prometheus metrics on, e.g. :9090 (disabled if empty)")
+	histogramOnly := flag.Bool("histogram-only", false, "Update -metrics histograms only; never read the event stream")
 	flag.Parse()
 
+	var syscalls []string
+	for _, name := range strings.Split(*syscallsFlag, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !validSyscalls[name] {
+			log.Fatalf("unknown syscall %q (want one of openat,openat2,unlinkat,statx,read,write,close)", name)
+		}
+		syscalls = append(syscalls, name)
+	}
+	if len(syscalls) == 0 {
+		log.Fatalf("-syscalls must name at least one syscall")
+	}
+
 	// Calculate threshold in nanoseconds.
 	var limitNs uint64 = uint64(*msFlag) * 1000000
 	if *errOnly {
@@ -94,98 +319,191 @@ func main() {
 		log.Fatalf("rlimit: %v", err)
 	}
 
+	// 1b. Kernel Feature Detection
+	// Older kernels (< 5.8) can't create a ringbuf map, and some locked-down
+	// or minimal kernels don't expose vmlinux BTF. Probe for both up front
+	// rather than letting loadBpf()/RewriteConstants fail deep inside setup.
+	caps := probe.Detect()
+	if !caps.Ringbuf {
+		log.Printf("badfd: no ringbuf support detected, falling back to a perf event array")
+	}
+	if !caps.BTF {
+		log.Printf("badfd: no vmlinux BTF detected, threading the latency threshold through a config map instead of CO-RE")
+	}
+
 	// 2. Load Spec
-	spec, err := loadBpf()
+	var spec *ebpf.CollectionSpec
+	var err error
+	if caps.Ringbuf {
+		spec, err = loadBpf()
+	} else {
+		spec, err = loadBpfPerf()
+	}
 	if err != nil {
 		log.Fatalf("load bpf: %v", err)
 	}
 
 	// 3. Injection Config
-	// Rewrite constants in the BPF bytecode *before* loading it into the kernel.
-	// This acts like runtime patching, allowing us to configure the
-	// latency threshold without recompiling the C code.
-	if err := spec.RewriteConstants(map[string]interface{}{
-		"min_duration_ns": uint64(limitNs),
-	}); err != nil {
-		log.Fatalf("rewrite constants: %v", err)
+	// Rewrite constants in the BPF bytecode *before* loading it into the
+	// kernel. This acts like runtime patching, allowing us to configure
+	// the latency threshold without recompiling the C code. Requires
+	// vmlinux BTF; without it we instead populate threshold_cfg after load.
+	if caps.BTF {
+		if err := spec.RewriteConstants(map[string]interface{}{
+			"min_duration_ns": uint64(limitNs),
+		}); err != nil {
+			log.Fatalf("rewrite constants: %v", err)
+		}
 	}
 
 	// 4. Load Objects
-	var objs bpfObjects
-	if err := spec.LoadAndAssign(&objs, nil); err != nil {
-		log.Fatalf("load objects: %v", err)
+	var m sharedMaps
+	var progPairs map[string]progPair
+	if caps.Ringbuf {
+		var objs bpfObjects
+		if err := spec.LoadAndAssign(&objs, nil); err != nil {
+			log.Fatalf("load objects: %v", err)
+		}
+		defer objs.Close()
+		m = mapsFromRingbuf(&objs)
+		progPairs = progPairsFromRingbuf(&objs)
+	} else {
+		var objs bpfPerfObjects
+		if err := spec.LoadAndAssign(&objs, nil); err != nil {
+			log.Fatalf("load objects: %v", err)
+		}
+		defer objs.Close()
+		m = mapsFromPerf(&objs)
+		progPairs = progPairsFromPerf(&objs)
 	}
-	defer objs.Close()
 
-	// 5. Attach Tracepoints
-	// We need to hook both ENTER (to start the timer) and EXIT (to stop it).
-	kpEnter, err := link.Tracepoint("syscalls", "sys_enter_openat", objs.TraceEntry, nil)
-	if err != nil {
-		log.Fatalf("link enter: %v", err)
+	// 4b. In-Kernel Filter Config
+	// PID/cgroup selection happens inside the BPF program now (see
+	// should_trace in c/badfd_common.h), so unwanted events are dropped
+	// before a start timestamp is ever recorded instead of being filtered
+	// out after the fact. Populate the lookup maps before we attach
+	// anything so there's no window where events leak through unfiltered.
+	pids := append(pidList(nil), pidFlag...)
+	if cmd != nil {
+		pids = append(pids, uint32(cmd.Process.Pid))
 	}
-	defer kpEnter.Close()
-
-	kpExit, err := link.Tracepoint("syscalls", "sys_exit_openat", objs.TraceExit, nil)
-	if err != nil {
-		log.Fatalf("link exit: %v", err)
+	for _, pid := range pids {
+		if err := m.TargetPids.Put(pid, uint8(1)); err != nil {
+			log.Fatalf("populate target_pids: %v", err)
+		}
 	}
-	defer kpExit.Close()
 
-	// 6. Ringbuffer Reader
-	rd, err := ringbuf.NewReader(objs.Events)
-	if err != nil {
-		log.Fatalf("ringbuf reader: %v", err)
+	var cfg bpfFilterConfig
+	if len(pids) > 0 {
+		cfg.FilterPids = 1
 	}
-	defer rd.Close()
-
-	// Header: Print only if running in human-readable CLI mode.
-	if !*jsonFlag {
-		fmt.Printf("%-8s %-16s %-10s %-20s %s\n", "PID", "COMM", "LATENCY", "RESULT", "FILE")
+	if *histogramOnly {
+		cfg.HistogramOnly = 1
+	}
+	if !caps.BTF {
+		if err := m.ThresholdCfg.Put(uint32(0), limitNs); err != nil {
+			log.Fatalf("populate threshold_cfg: %v", err)
+		}
+		cfg.UseMapThreshold = 1
+	}
+	if *cgroupFlag != "" {
+		cgid, err := resolveCgroupID(*cgroupFlag)
+		if err != nil {
+			log.Fatalf("resolve cgroup: %v", err)
+		}
+		if err := m.TargetCgroups.Put(cgid, uint8(1)); err != nil {
+			log.Fatalf("populate target_cgroups: %v", err)
+		}
+		cfg.FilterCgroups = 1
+	}
+	if err := m.FilterCfg.Put(uint32(0), cfg); err != nil {
+		log.Fatalf("populate filter_cfg: %v", err)
 	}
 
-	// 7. Signal Handling
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-
-	go func() {
-		if cmd != nil {
-			cmd.Wait()            // Wait for child process
-			sig <- syscall.SIGINT // Trigger shutdown
+	// 5. Attach Tracepoints
+	// Every requested syscall gets its own ENTER (start the timer) and
+	// EXIT (stop it, emit the event) tracepoint pair. Links are collected
+	// so they can all be torn down together on shutdown.
+	var links []link.Link
+	defer func() {
+		for _, l := range links {
+			l.Close()
 		}
 	}()
 
-	go func() {
-		<-sig
-		rd.Close()
-	}()
+	for _, name := range syscalls {
+		if !probe.HasTracepoint(name) {
+			log.Fatalf("syscall %q has no syscalls:sys_enter_%s/sys_exit_%s tracepoint on this kernel", name, name, name)
+		}
 
-	// 8. Event Loop
-	for {
-		record, err := rd.Read()
+		progs := progPairs[name]
+
+		kpEnter, err := link.Tracepoint("syscalls", "sys_enter_"+name, progs.Entry, nil)
 		if err != nil {
-			if errors.Is(err, ringbuf.ErrClosed) {
-				return
-			}
-			continue
+			log.Fatalf("link enter %s: %v", name, err)
 		}
+		links = append(links, kpEnter)
 
-		var event bpfEventT
-		if err := binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, &event); err != nil {
-			continue
+		kpExit, err := link.Tracepoint("syscalls", "sys_exit_"+name, progs.Exit, nil)
+		if err != nil {
+			log.Fatalf("link exit %s: %v", name, err)
 		}
+		links = append(links, kpExit)
+	}
+
+	// 5b. Metrics Exporter
+	// The BPF side (update_stats in c/badfd_common.h) maintains per-comm/
+	// syscall histograms and counters on every completed syscall regardless
+	// of -ms/-err/-histogram-only, so -metrics stays accurate even when the
+	// event stream is filtered down or disabled.
+	if *metricsFlag != "" {
+		startMetricsServer(*metricsFlag, m)
+	}
+
+	if *histogramOnly {
+		// No event reader in this mode -- the tool just keeps the program
+		// attached (feeding the stats maps above) until it's told to stop.
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			if cmd != nil {
+				cmd.Wait()
+				sig <- syscall.SIGINT
+			}
+		}()
+		<-sig
+		return
+	}
 
-		// Userspace PID filtering (Optional for Exec mode).
-		// Note: Ideally, filtering should happen in kernel space using a PID map,
-		// but for v1 doing it in userspace is simpler and acceptable.
-		if cmd != nil && int(event.Pid) != cmd.Process.Pid {
-			// continue
+	// Header: Print only if running in human-readable CLI mode.
+	if !*jsonFlag {
+		fmt.Printf("%-8s %-16s %-10s %-10s %-20s %s\n", "PID", "COMM", "SYSCALL", "LATENCY", "RESULT", "FILE/FD")
+	}
+
+	printEvent := func(raw []byte) {
+		event, err := decodeEvent(raw)
+		if err != nil {
+			return
 		}
 
-		// Data preparation
 		lat := time.Duration(event.DurationNs)
 		comm := string(bytes.TrimRight(event.Comm[:], "\x00"))
-		fname := string(bytes.TrimRight(event.Fname[:], "\x00"))
 		res := fmtErr(event.Ret)
+		sc := syscallName(event.SyscallId)
+
+		// The payload field that matters depends on which syscall
+		// produced the event: path-based syscalls carry a filename,
+		// fd-based ones carry an fd (and, for read/write, a count).
+		var payload string
+		fname := ""
+		if isPathSyscall(event.SyscallId) {
+			fname = string(bytes.TrimRight(event.Fname[:], "\x00"))
+			payload = fname
+		} else if event.Count > 0 {
+			payload = fmt.Sprintf("fd=%d count=%d", event.Fd, event.Count)
+		} else {
+			payload = fmt.Sprintf("fd=%d", event.Fd)
+		}
 
 		if *jsonFlag {
 			// --- JSON MODE (Machine Friendly) ---
@@ -193,18 +511,85 @@ func main() {
 				Timestamp: time.Now().Format(time.RFC3339),
 				Pid:       event.Pid,
 				Comm:      comm,
+				Syscall:   sc,
 				LatencyNs: event.DurationNs,
 				Result:    res,
 				File:      fname,
 			}
+			if !isPathSyscall(event.SyscallId) {
+				entry.Fd = event.Fd
+				entry.Count = event.Count
+			}
 			b, err := json.Marshal(entry)
 			if err == nil {
 				fmt.Println(string(b))
 			}
 		} else {
 			// --- CLI MODE (Human Friendly) ---
-			fmt.Printf("%-8d %-16s %-10s %-20s %s\n",
-				event.Pid, comm, lat, res, fname)
+			fmt.Printf("%-8d %-16s %-10s %-10s %-20s %s\n",
+				event.Pid, comm, sc, lat, res, payload)
+		}
+	}
+
+	// 7. Signal Handling
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		if cmd != nil {
+			cmd.Wait()            // Wait for child process
+			sig <- syscall.SIGINT // Trigger shutdown
+		}
+	}()
+
+	// 6/8. Event Reader + Loop
+	// The reader type (ringbuf vs perf) depends on what probe.Detect()
+	// found, but both feed the same printEvent closure.
+	if caps.Ringbuf {
+		rd, err := ringbuf.NewReader(m.Events)
+		if err != nil {
+			log.Fatalf("ringbuf reader: %v", err)
+		}
+		defer rd.Close()
+		go func() {
+			<-sig
+			rd.Close()
+		}()
+
+		for {
+			record, err := rd.Read()
+			if err != nil {
+				if errors.Is(err, ringbuf.ErrClosed) {
+					return
+				}
+				continue
+			}
+			printEvent(record.RawSample)
+		}
+	}
+
+	rd, err := perf.NewReader(m.Events, os.Getpagesize())
+	if err != nil {
+		log.Fatalf("perf reader: %v", err)
+	}
+	defer rd.Close()
+	go func() {
+		<-sig
+		rd.Close()
+	}()
+
+	for {
+		record, err := rd.Read()
+		if err != nil {
+			if errors.Is(err, perf.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if record.LostSamples > 0 {
+			log.Printf("badfd: lost %d events (perf buffer full)", record.LostSamples)
+			continue
 		}
+		printEvent(record.RawSample)
 	}
 }
@@ -0,0 +1,209 @@
+package main
+
+// Hand-rolled Prometheus/OpenMetrics text exporter. badfd only ever needs
+// a handful of histogram/counter series, so this skips pulling in the
+// full client_golang dependency tree in favor of writing the exposition
+// format directly -- same tradeoff as errnoNames in main.go.
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const metricsScrapeInterval = 5 * time.Second
+
+// commLen mirrors TASK_COMM_LEN in c/badfd_common.h.
+const commLen = 16
+
+// syscallStatsKey groups the BPF-side aggregates by comm and syscall, the
+// same breakdown the Prometheus series are labeled by.
+type syscallStatsKey struct {
+	Comm      string
+	SyscallID uint32
+}
+
+type syscallStats struct {
+	count   uint64
+	sumNs   uint64
+	buckets map[uint32]uint64 // log2 bucket -> sample count
+	errors  map[uint32]uint64 // errno -> failure count
+}
+
+// startMetricsServer launches the background collector that periodically
+// walks the BPF stats maps, and an HTTP server that serves the most
+// recent rendering on /metrics. Both run for the lifetime of the process.
+func startMetricsServer(addr string, m sharedMaps) {
+	var snapshot atomic.Value
+	snapshot.Store("")
+
+	go func() {
+		for {
+			stats := collectStats(m)
+			snapshot.Store(renderPrometheus(stats))
+			time.Sleep(metricsScrapeInterval)
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, snapshot.Load().(string))
+	})
+
+	go func() {
+		log.Printf("badfd: serving metrics on %s/metrics", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalf("metrics server: %v", err)
+		}
+	}()
+}
+
+// commString decodes a bpf2go char[] comm field, trimming the trailing
+// NUL padding the kernel leaves in task_struct->comm.
+func commString(comm [commLen]int8) string {
+	buf := make([]byte, len(comm))
+	for i, c := range comm {
+		buf[i] = byte(c)
+	}
+	return string(bytes.TrimRight(buf, "\x00"))
+}
+
+// collectStats walks the three percpu stats maps and folds each map's
+// per-CPU slice values into process-wide totals, keyed by comm+syscall.
+func collectStats(m sharedMaps) map[syscallStatsKey]*syscallStats {
+	stats := make(map[syscallStatsKey]*syscallStats)
+	get := func(k syscallStatsKey) *syscallStats {
+		s, ok := stats[k]
+		if !ok {
+			s = &syscallStats{buckets: map[uint32]uint64{}, errors: map[uint32]uint64{}}
+			stats[k] = s
+		}
+		return s
+	}
+
+	var ckey bpfCountKey
+	var cvals []bpfCountVal
+	totals := m.SyscallTotals.Iterate()
+	for totals.Next(&ckey, &cvals) {
+		s := get(syscallStatsKey{Comm: commString(ckey.Comm), SyscallID: ckey.SyscallId})
+		for _, v := range cvals {
+			s.count += v.Count
+			s.sumNs += v.SumNs
+		}
+	}
+	if err := totals.Err(); err != nil {
+		log.Printf("badfd: iterate syscall_totals: %v", err)
+	}
+
+	var hkey bpfHistKey
+	var hvals []uint64
+	hist := m.SyscallLatencyHist.Iterate()
+	for hist.Next(&hkey, &hvals) {
+		s := get(syscallStatsKey{Comm: commString(hkey.Comm), SyscallID: hkey.SyscallId})
+		var sum uint64
+		for _, v := range hvals {
+			sum += v
+		}
+		s.buckets[hkey.Bucket] += sum
+	}
+	if err := hist.Err(); err != nil {
+		log.Printf("badfd: iterate syscall_latency_hist: %v", err)
+	}
+
+	var ekey bpfErrorKey
+	var evals []uint64
+	errs := m.SyscallErrors.Iterate()
+	for errs.Next(&ekey, &evals) {
+		s := get(syscallStatsKey{Comm: commString(ekey.Comm), SyscallID: ekey.SyscallId})
+		var sum uint64
+		for _, v := range evals {
+			sum += v
+		}
+		s.errors[ekey.Errno] += sum
+	}
+	if err := errs.Err(); err != nil {
+		log.Printf("badfd: iterate syscall_errors: %v", err)
+	}
+
+	return stats
+}
+
+// renderPrometheus formats the collected stats as Prometheus text
+// exposition format. Bucket boundaries follow the kernel-side
+// log2_bucket(): bucket i's cumulative "le" is 2^i - 1 nanoseconds.
+func renderPrometheus(stats map[syscallStatsKey]*syscallStats) string {
+	keys := make([]syscallStatsKey, 0, len(stats))
+	for k := range stats {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Comm != keys[j].Comm {
+			return keys[i].Comm < keys[j].Comm
+		}
+		return keys[i].SyscallID < keys[j].SyscallID
+	})
+
+	var b strings.Builder
+	b.WriteString("# HELP badfd_syscall_latency_seconds Syscall latency distribution.\n")
+	b.WriteString("# TYPE badfd_syscall_latency_seconds histogram\n")
+	for _, k := range keys {
+		s := stats[k]
+		sc := syscallName(k.SyscallID)
+
+		var maxBucket uint32
+		for bucket := range s.buckets {
+			if bucket > maxBucket {
+				maxBucket = bucket
+			}
+		}
+
+		var cumulative uint64
+		for bucket := uint32(0); bucket <= maxBucket; bucket++ {
+			cumulative += s.buckets[bucket]
+			le := float64((uint64(1)<<bucket)-1) / 1e9
+			fmt.Fprintf(&b, "badfd_syscall_latency_seconds_bucket{comm=%q,syscall=%q,le=\"%g\"} %d\n",
+				k.Comm, sc, le, cumulative)
+		}
+		fmt.Fprintf(&b, "badfd_syscall_latency_seconds_bucket{comm=%q,syscall=%q,le=\"+Inf\"} %d\n", k.Comm, sc, s.count)
+		fmt.Fprintf(&b, "badfd_syscall_latency_seconds_count{comm=%q,syscall=%q} %d\n", k.Comm, sc, s.count)
+		fmt.Fprintf(&b, "badfd_syscall_latency_seconds_sum{comm=%q,syscall=%q} %g\n", k.Comm, sc, float64(s.sumNs)/1e9)
+	}
+
+	b.WriteString("# HELP badfd_syscall_errors_total Syscall failures by errno.\n")
+	b.WriteString("# TYPE badfd_syscall_errors_total counter\n")
+	for _, k := range keys {
+		s := stats[k]
+		sc := syscallName(k.SyscallID)
+
+		errnos := make([]uint32, 0, len(s.errors))
+		for e := range s.errors {
+			errnos = append(errnos, e)
+		}
+		sort.Slice(errnos, func(i, j int) bool { return errnos[i] < errnos[j] })
+
+		for _, errno := range errnos {
+			fmt.Fprintf(&b, "badfd_syscall_errors_total{comm=%q,syscall=%q,errno=%q} %d\n",
+				k.Comm, sc, errnoLabel(errno), s.errors[errno])
+		}
+	}
+
+	return b.String()
+}
+
+// errnoLabel turns an errno into a bare symbol ("ENOENT") for the
+// Prometheus label, reusing errnoNames' descriptions from main.go.
+func errnoLabel(errno uint32) string {
+	name, ok := errnoNames[int32(errno)]
+	if !ok {
+		return fmt.Sprintf("%d", errno)
+	}
+	if idx := strings.IndexByte(name, ' '); idx > 0 {
+		return name[:idx]
+	}
+	return name
+}
@@ -0,0 +1,92 @@
+// Package probe runs a handful of cheap feature checks at startup so the
+// loader can pick a BPF program variant and helper API that this kernel
+// actually supports, instead of failing outright on older kernels.
+package probe
+
+import (
+	"os"
+
+	"github.com/cilium/ebpf"
+)
+
+const vmlinuxBTFPath = "/sys/kernel/btf/vmlinux"
+
+// tracepointSyscallsDirs mirrors the tracefs resolution order
+// github.com/cilium/ebpf/link.Tracepoint uses internally: tracefs mounted
+// directly at /sys/kernel/tracing is preferred, falling back to the
+// classic debugfs mount point only if that doesn't exist. Hardened kernels
+// commonly mount tracefs without debugfs at all, so checking only the
+// debugfs path would report every tracepoint missing on those hosts.
+var tracepointSyscallsDirs = []string{
+	"/sys/kernel/tracing/events/syscalls",
+	"/sys/kernel/debug/tracing/events/syscalls",
+}
+
+// Capabilities summarizes what this kernel supports.
+type Capabilities struct {
+	// Ringbuf is true if BPF_MAP_TYPE_RINGBUF can be created here
+	// (Linux >= 5.8). When false, the loader should fall back to a
+	// BPF_MAP_TYPE_PERF_EVENT_ARRAY program variant and perf.NewReader.
+	Ringbuf bool
+	// BTF is true if vmlinux BTF is exposed, meaning CO-RE constant
+	// rewriting (spec.RewriteConstants) is available. When false, the
+	// loader should write the latency threshold into a config map
+	// instead of rewriting the BPF program's .rodata.
+	BTF bool
+}
+
+// Detect runs the feature probes and reports what's available.
+func Detect() Capabilities {
+	return Capabilities{
+		Ringbuf: hasRingbuf(),
+		BTF:     hasBTF(),
+	}
+}
+
+// hasRingbuf attempts to create a throwaway ring buffer map. Creation
+// fails with ENOTSUPP/EINVAL on kernels older than 5.8.
+func hasRingbuf() bool {
+	m, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.RingBuf,
+		MaxEntries: 4096,
+	})
+	if err != nil {
+		return false
+	}
+	m.Close()
+	return true
+}
+
+// hasBTF reports whether the kernel exposes its own BTF, which CO-RE
+// constant rewriting and relocations depend on.
+func hasBTF() bool {
+	_, err := os.Stat(vmlinuxBTFPath)
+	return err == nil
+}
+
+// HasTracepoint reports whether the syscalls:sys_enter_<name>/
+// syscalls:sys_exit_<name> tracepoint pair is available, so -syscalls can
+// fail fast on a clear error instead of an opaque link.Tracepoint one.
+func HasTracepoint(name string) bool {
+	dir := tracepointSyscallsDir()
+	if dir == "" {
+		return false
+	}
+	for _, leg := range []string{"sys_enter_" + name, "sys_exit_" + name} {
+		if _, err := os.Stat(dir + "/" + leg); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// tracepointSyscallsDir returns whichever of tracepointSyscallsDirs exists
+// on this host, or "" if neither does.
+func tracepointSyscallsDir() string {
+	for _, dir := range tracepointSyscallsDirs {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return dir
+		}
+	}
+	return ""
+}